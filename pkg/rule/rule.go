@@ -0,0 +1,321 @@
+// Package rule implements threshold-based alerting rules evaluated
+// periodically against the log stream, in the spirit of Prometheus
+// recording/alerting rules but over raw matching record counts instead
+// of metric samples.
+package rule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	level "github.com/go-kit/kit/log/experimental_level"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// QueryFunc counts log records matching pattern within the trailing
+// window ending now. Implementations typically fan the count out across
+// the store cluster, the same way the query API does.
+type QueryFunc func(ctx context.Context, pattern string, window time.Duration) (int, error)
+
+// State is the lifecycle of a Rule's evaluation.
+type State string
+
+// The possible states of a Rule, mirroring Prometheus alert states.
+const (
+	StateInactive State = "inactive"
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+)
+
+// Rule goes pending when at least Threshold records matching Pattern
+// are seen within the trailing For window, and fires once it has stayed
+// pending for at least For.
+type Rule struct {
+	Name      string            `yaml:"name" json:"name"`
+	Pattern   string            `yaml:"pattern" json:"pattern"`
+	Threshold int               `yaml:"threshold" json:"threshold"`
+	For       time.Duration     `yaml:"for" json:"for"`
+	Labels    map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+
+	state         State
+	activeSince   time.Time
+	lastValue     int
+	lastEvaluated time.Time
+}
+
+// State returns the rule's current evaluation state, for API responses.
+func (r *Rule) State() State { return r.state }
+
+// MarshalJSON includes the evaluation state alongside Rule's static
+// fields, so GET /rules reports each rule's current state, last-seen
+// value, and last-evaluation time instead of just its static
+// configuration.
+func (r *Rule) MarshalJSON() ([]byte, error) {
+	type alias Rule
+	return json.Marshal(struct {
+		*alias
+		State         State     `json:"state"`
+		ActiveSince   time.Time `json:"active_since,omitempty"`
+		LastValue     int       `json:"last_value"`
+		LastEvaluated time.Time `json:"last_evaluated,omitempty"`
+	}{
+		alias:         (*alias)(r),
+		State:         r.state,
+		ActiveSince:   r.activeSince,
+		LastValue:     r.lastValue,
+		LastEvaluated: r.lastEvaluated,
+	})
+}
+
+// Group is a set of rules sharing a common evaluation interval.
+type Group struct {
+	Name     string        `yaml:"name" json:"name"`
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	Rules    []*Rule       `yaml:"rules" json:"rules"`
+}
+
+// config is the on-disk YAML shape loaded from the rules file.
+type config struct {
+	Groups []*Group `yaml:"groups"`
+}
+
+// Alert is a currently pending or firing instance of a Rule.
+type Alert struct {
+	RuleName    string            `json:"rule"`
+	GroupName   string            `json:"group"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Value       int               `json:"value"`
+	ActiveSince time.Time         `json:"active_since"`
+	State       State             `json:"state"`
+}
+
+// Manager loads rule groups from a YAML file, evaluates them on a
+// schedule via QueryFunc, and optionally pushes firing alerts to a
+// configured webhook.
+type Manager struct {
+	mu         sync.Mutex
+	path       string
+	groups     []*Group
+	query      QueryFunc
+	webhookURL string
+	client     *http.Client
+	logger     log.Logger
+
+	runCtx       context.Context    // the ctx passed to Run, once it's been called
+	cancelGroups context.CancelFunc // stops the runGroup goroutines started for the current groups
+}
+
+// NewManager returns a Manager with its rules loaded from path, ready to
+// Run. If path is empty the Manager starts with no rule groups, and
+// Reload returns an error, since there is no rules file to read.
+func NewManager(path string, query QueryFunc, webhookURL string, logger log.Logger) (*Manager, error) {
+	m := &Manager{
+		path:       path,
+		query:      query,
+		webhookURL: webhookURL,
+		client:     http.DefaultClient,
+		logger:     logger,
+	}
+	if path != "" {
+		if err := m.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Reload re-reads and re-parses the rules file, replacing the active
+// rule groups. It's safe to call concurrently with Run.
+func (m *Manager) Reload() error {
+	if m.path == "" {
+		return errors.New("no rules file configured")
+	}
+	buf, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return errors.Wrap(err, "reading rules file")
+	}
+	var cfg config
+	if err := yaml.Unmarshal(buf, &cfg); err != nil {
+		return errors.Wrap(err, "parsing rules file")
+	}
+	for _, g := range cfg.Groups {
+		for _, r := range g.Rules {
+			if _, err := regexp.Compile(r.Pattern); err != nil {
+				return errors.Wrapf(err, "compiling pattern for rule %q", r.Name)
+			}
+			r.state = StateInactive
+		}
+	}
+	m.mu.Lock()
+	m.groups = cfg.Groups
+	m.mu.Unlock()
+	m.startGroups(cfg.Groups)
+	level.Info(m.logger).Log("msg", "rules reloaded", "file", m.path, "groups", len(cfg.Groups))
+	return nil
+}
+
+// Run starts evaluating every rule group on its own interval until ctx
+// is done. It's the Manager's root context: a later Reload restarts
+// group goroutines as children of it, so they still stop when ctx does.
+func (m *Manager) Run(ctx context.Context) {
+	m.mu.Lock()
+	m.runCtx = ctx
+	groups := m.groups
+	m.mu.Unlock()
+	m.startGroups(groups)
+}
+
+// startGroups stops the runGroup goroutines started for whatever groups
+// were previously running, then starts one fresh runGroup goroutine per
+// group in groups. Called from Run, and again from Reload so a reload
+// doesn't leave the old groups' goroutines evaluating stale *Group
+// objects forever nor leave the new groups without any evaluation loop.
+// It's a no-op until Run has been called at least once, since there's
+// no root context to scope the new goroutines to yet; Run picks up
+// whatever groups are current when it does start.
+func (m *Manager) startGroups(groups []*Group) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cancelGroups != nil {
+		m.cancelGroups()
+		m.cancelGroups = nil
+	}
+	if m.runCtx == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(m.runCtx)
+	m.cancelGroups = cancel
+	for _, g := range groups {
+		go m.runGroup(ctx, g)
+	}
+}
+
+func (m *Manager) runGroup(ctx context.Context, g *Group) {
+	interval := g.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.evaluateGroup(ctx, g)
+		}
+	}
+}
+
+func (m *Manager) evaluateGroup(ctx context.Context, g *Group) {
+	for _, r := range g.Rules {
+		n, err := m.query(ctx, r.Pattern, r.For)
+		if err != nil {
+			level.Error(m.logger).Log("during", "rule_eval", "rule", r.Name, "err", err)
+			continue
+		}
+
+		m.mu.Lock()
+		r.lastValue = n
+		r.lastEvaluated = time.Now()
+		firing := n >= r.Threshold
+		prevState := r.state
+		switch {
+		case !firing:
+			r.state = StateInactive
+		case prevState != StatePending && prevState != StateFiring:
+			// Just started breaching (from StateInactive, or from the
+			// zero state of a never-evaluated Rule): go pending and
+			// start the For clock. activeSince marks when the rule first
+			// started breaching, same as Prometheus's ActiveAt, so it
+			// doesn't reset if and when the rule moves on to StateFiring.
+			r.state = StatePending
+			r.activeSince = time.Now()
+		}
+		if r.state == StatePending && time.Since(r.activeSince) >= r.For {
+			r.state = StateFiring
+		}
+		justFired := r.state == StateFiring && prevState != StateFiring
+		m.mu.Unlock()
+
+		if justFired {
+			m.notify(g, r)
+		}
+	}
+}
+
+// notify pushes an Alertmanager-compatible payload describing the firing
+// rule to the configured webhook, if any.
+func (m *Manager) notify(g *Group, r *Rule) {
+	if m.webhookURL == "" {
+		return
+	}
+
+	labels := map[string]string{"alertname": r.Name, "group": g.Name}
+	for k, v := range r.Labels {
+		labels[k] = v
+	}
+	payload := []struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		StartsAt    time.Time         `json:"startsAt"`
+	}{{
+		Labels:      labels,
+		Annotations: map[string]string{"pattern": r.Pattern},
+		StartsAt:    r.activeSince,
+	}}
+
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		level.Error(m.logger).Log("during", "rule_notify", "err", err)
+		return
+	}
+	resp, err := m.client.Post(m.webhookURL, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		level.Error(m.logger).Log("during", "rule_notify", "err", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// Groups returns the currently loaded rule groups, for API responses.
+func (m *Manager) Groups() []*Group {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.groups
+}
+
+// Alerts returns every pending or firing alert instance across all
+// groups, for API responses.
+func (m *Manager) Alerts() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var alerts []Alert
+	for _, g := range m.groups {
+		for _, r := range g.Rules {
+			if r.state == StateInactive {
+				continue
+			}
+			alerts = append(alerts, Alert{
+				RuleName:    r.Name,
+				GroupName:   g.Name,
+				Labels:      r.Labels,
+				Value:       r.lastValue,
+				ActiveSince: r.activeSince,
+				State:       r.state,
+			})
+		}
+	}
+	return alerts
+}
@@ -0,0 +1,196 @@
+package rule
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func testLogger() log.Logger { return log.NewNopLogger() }
+
+func TestEvaluateGroupPendingThenFiring(t *testing.T) {
+	var notified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&notified, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	breaching := true
+	m := &Manager{
+		query: func(ctx context.Context, pattern string, window time.Duration) (int, error) {
+			if breaching {
+				return 1, nil
+			}
+			return 0, nil
+		},
+		webhookURL: srv.URL,
+		client:     http.DefaultClient,
+		logger:     testLogger(),
+	}
+	g := &Group{
+		Name:     "g",
+		Interval: time.Millisecond,
+		Rules:    []*Rule{{Name: "r", Pattern: "x", Threshold: 1, For: 30 * time.Millisecond}},
+	}
+
+	m.evaluateGroup(context.Background(), g)
+	if got := g.Rules[0].State(); got != StatePending {
+		t.Fatalf("after first breach, state = %q, want %q", got, StatePending)
+	}
+	if n := atomic.LoadInt32(&notified); n != 0 {
+		t.Fatalf("notified = %d while only pending, want 0", n)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	m.evaluateGroup(context.Background(), g)
+	if got := g.Rules[0].State(); got != StateFiring {
+		t.Fatalf("after sustained breach, state = %q, want %q", got, StateFiring)
+	}
+	if n := atomic.LoadInt32(&notified); n != 1 {
+		t.Fatalf("notified = %d after firing transition, want 1", n)
+	}
+
+	m.evaluateGroup(context.Background(), g)
+	if n := atomic.LoadInt32(&notified); n != 1 {
+		t.Fatalf("notified = %d after staying firing, want still 1", n)
+	}
+
+	breaching = false
+	m.evaluateGroup(context.Background(), g)
+	if got := g.Rules[0].State(); got != StateInactive {
+		t.Fatalf("after breach clears, state = %q, want %q", got, StateInactive)
+	}
+}
+
+func TestRuleMarshalJSONIncludesEvaluationState(t *testing.T) {
+	breaching := true
+	m := &Manager{
+		query: func(ctx context.Context, pattern string, window time.Duration) (int, error) {
+			if breaching {
+				return 5, nil
+			}
+			return 0, nil
+		},
+		logger: testLogger(),
+	}
+	g := &Group{
+		Name:  "g",
+		Rules: []*Rule{{Name: "r", Pattern: "x", Threshold: 1, For: 0}},
+	}
+
+	m.evaluateGroup(context.Background(), g)
+
+	buf, err := json.Marshal(g.Rules[0])
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	var got struct {
+		Name          string    `json:"name"`
+		State         State     `json:"state"`
+		LastValue     int       `json:"last_value"`
+		LastEvaluated time.Time `json:"last_evaluated"`
+	}
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	if got.Name != "r" {
+		t.Errorf("name = %q, want %q", got.Name, "r")
+	}
+	if got.State != StateFiring {
+		t.Errorf("state = %q, want %q", got.State, StateFiring)
+	}
+	if got.LastValue != 5 {
+		t.Errorf("last_value = %d, want 5", got.LastValue)
+	}
+	if got.LastEvaluated.IsZero() {
+		t.Error("last_evaluated = zero time, want it populated")
+	}
+}
+
+func TestManagerReloadRestartsGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rule-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/rules.yaml"
+
+	const cfgA = `
+groups:
+- name: ga
+  interval: 5000000
+  rules:
+  - name: ra
+    pattern: a
+    threshold: 1
+    for: 0
+`
+	const cfgB = `
+groups:
+- name: gb
+  interval: 5000000
+  rules:
+  - name: rb
+    pattern: b
+    threshold: 1
+    for: 0
+`
+	if err := ioutil.WriteFile(path, []byte(cfgA), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+	query := func(ctx context.Context, pattern string, window time.Duration) (int, error) {
+		mu.Lock()
+		counts[pattern]++
+		mu.Unlock()
+		return 1, nil
+	}
+
+	m, err := NewManager(path, query, "", testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Run(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	aBefore := counts["a"]
+	mu.Unlock()
+	if aBefore == 0 {
+		t.Fatal("expected group ga to have been evaluated before reload")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(cfgB), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	aAfter, bAfter := counts["a"], counts["b"]
+	mu.Unlock()
+	if bAfter == 0 {
+		t.Fatal("expected group gb to be evaluated after reload")
+	}
+	if aAfter != aBefore {
+		t.Fatalf("group ga kept evaluating after reload: %d -> %d", aBefore, aAfter)
+	}
+}
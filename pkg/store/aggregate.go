@@ -0,0 +1,328 @@
+package store
+
+import (
+	"bufio"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// AggregateOp names one of the supported /query aggregation operators.
+type AggregateOp string
+
+// The aggregate= operators accepted alongside a normal query.
+//
+// AggregateCount and AggregateCountOverTime mirror PromQL's count vs.
+// count_over_time: both bucket matches by step while accumulating, but
+// AggregateCount's Finalize collapses every series down to one instant
+// total, while AggregateCountOverTime keeps the per-step series.
+const (
+	AggregateCount             AggregateOp = "count"
+	AggregateCountOverTime     AggregateOp = "count_over_time"
+	AggregateRate              AggregateOp = "rate"
+	AggregateTopK              AggregateOp = "topk"
+	AggregateHistogramQuantile AggregateOp = "histogram_quantile"
+)
+
+// AggregateSpec is the parsed aggregate=/step=/by= portion of a query.
+type AggregateSpec struct {
+	Op       AggregateOp
+	Step     time.Duration
+	By       *regexp.Regexp // first capture group becomes the series label
+	K        int            // for topk
+	Quantile float64        // for histogram_quantile
+}
+
+// ParseAggregateSpec reads aggregate=, step=, by=, k=, and quantile=
+// from values. It returns (nil, nil) when aggregate= isn't set, so
+// callers can fall back to the existing raw-record query path.
+func ParseAggregateSpec(values url.Values) (*AggregateSpec, error) {
+	op := AggregateOp(values.Get("aggregate"))
+	if op == "" {
+		return nil, nil
+	}
+
+	spec := &AggregateSpec{Op: op, Step: time.Minute, K: 10, Quantile: 0.99}
+
+	switch op {
+	case AggregateCount, AggregateCountOverTime, AggregateRate, AggregateTopK, AggregateHistogramQuantile:
+	default:
+		return nil, errors.Errorf("unsupported aggregate %q", op)
+	}
+
+	if raw := values.Get("step"); raw != "" {
+		step, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing step")
+		}
+		spec.Step = step
+	}
+
+	if raw := values.Get("by"); raw != "" {
+		re, err := regexp.Compile(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing by")
+		}
+		if re.NumSubexp() < 1 {
+			return nil, errors.New("by must contain at least one capture group")
+		}
+		spec.By = re
+	}
+
+	if op == AggregateHistogramQuantile && spec.By == nil {
+		return nil, errors.New("histogram_quantile requires by= to capture the bucket's upper bound (le)")
+	}
+
+	if raw := values.Get("k"); raw != "" {
+		k, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing k")
+		}
+		if k < 1 {
+			return nil, errors.New("k must be positive")
+		}
+		spec.K = k
+	}
+
+	if raw := values.Get("quantile"); raw != "" {
+		q, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing quantile")
+		}
+		spec.Quantile = q
+	}
+
+	return spec, nil
+}
+
+// AggregatePoint is a single bucketed sample in a time series.
+type AggregatePoint struct {
+	Timestamp time.Time `json:"ts"`
+	Value     float64   `json:"value"`
+}
+
+// AggregateResult is the compact JSON time-series form returned in
+// place of raw records when a query requests aggregate=. Series is
+// keyed by the by= capture group value ("" if by= wasn't set).
+type AggregateResult struct {
+	Op         AggregateOp                 `json:"op"`
+	Step       time.Duration               `json:"step"`
+	Series     map[string][]AggregatePoint `json:"series"`
+	ErrorCount int                         `json:"error_count,omitempty"`
+}
+
+// NewAggregateResult returns an empty result ready for accumulation.
+func NewAggregateResult(spec AggregateSpec) AggregateResult {
+	return AggregateResult{
+		Op:     spec.Op,
+		Step:   spec.Step,
+		Series: map[string][]AggregatePoint{},
+	}
+}
+
+// Add folds one matching record, observed at ts with the given series
+// label, into the result, bucketing it down to the start of its Step
+// interval. Only the series' last bucket is compared, so a point older
+// than that bucket starts a new, separate point for its bucket.
+func (r *AggregateResult) Add(series string, ts time.Time, value float64) {
+	bucket := ts.Truncate(r.Step)
+	points := r.Series[series]
+	if n := len(points); n > 0 && points[n-1].Timestamp.Equal(bucket) {
+		points[n-1].Value += value
+		return
+	}
+	r.Series[series] = append(points, AggregatePoint{Timestamp: bucket, Value: value})
+}
+
+// Merge combines a partial per-store AggregateResult into r: matching
+// (series, bucket) pairs have their counts summed, which is correct for
+// count and count_over_time, and for rate/topk/histogram_quantile once
+// finalized from the summed buckets (see Finalize).
+func (r *AggregateResult) Merge(other AggregateResult) error {
+	if other.Op != "" && r.Op != "" && other.Op != r.Op {
+		return errors.Errorf("cannot merge aggregate %q into %q", other.Op, r.Op)
+	}
+	for series, points := range other.Series {
+	merge:
+		for _, p := range points {
+			existing := r.Series[series]
+			for i := range existing {
+				if existing[i].Timestamp.Equal(p.Timestamp) {
+					existing[i].Value += p.Value
+					continue merge
+				}
+			}
+			r.Series[series] = append(existing, p)
+		}
+	}
+	return nil
+}
+
+// Finalize applies any operator-specific post-processing that only
+// makes sense once every store's partial counts have been merged: count
+// collapses each series down to a single instant total (unlike
+// count_over_time, which keeps the per-step buckets Add already
+// produced), rate divides by the step width, and topk trims every
+// series down to the top spec.K points by value.
+func (r *AggregateResult) Finalize(spec AggregateSpec) {
+	switch spec.Op {
+	case AggregateCount:
+		for series, points := range r.Series {
+			if len(points) == 0 {
+				continue
+			}
+			var total float64
+			for _, p := range points {
+				total += p.Value
+			}
+			r.Series[series] = []AggregatePoint{{Timestamp: points[len(points)-1].Timestamp, Value: total}}
+		}
+	case AggregateRate:
+		seconds := spec.Step.Seconds()
+		if seconds <= 0 {
+			seconds = 1
+		}
+		for _, points := range r.Series {
+			for i := range points {
+				points[i].Value /= seconds
+			}
+		}
+	case AggregateTopK:
+		for series, points := range r.Series {
+			sort.Slice(points, func(i, j int) bool { return points[i].Value > points[j].Value })
+			if len(points) > spec.K {
+				points = points[:spec.K]
+			}
+			r.Series[series] = points
+		}
+	case AggregateHistogramQuantile:
+		r.Series = finalizeHistogramQuantile(r.Series, spec.Quantile)
+	}
+	for _, points := range r.Series {
+		sort.Slice(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	}
+}
+
+// leBucket is one upper-bound/cumulative-count pair of a classic
+// Prometheus-style histogram, used to interpolate a quantile.
+type leBucket struct {
+	upperBound float64
+	count      float64
+}
+
+// finalizeHistogramQuantile collapses the per-bucket series produced by
+// by= (each keyed by its "le" upper bound, e.g. "0.5" or "+Inf") into a
+// single "" series holding the interpolated spec.Quantile at every
+// timestamp. The per-bucket counts summed in from every store are the
+// number of observations that fell in that exact bucket, so they're
+// made cumulative here, after the merge, before interpolating.
+func finalizeHistogramQuantile(series map[string][]AggregatePoint, quantile float64) map[string][]AggregatePoint {
+	byTimestamp := map[time.Time][]leBucket{}
+	for key, points := range series {
+		upperBound, err := parseLe(key)
+		if err != nil {
+			continue
+		}
+		for _, p := range points {
+			byTimestamp[p.Timestamp] = append(byTimestamp[p.Timestamp], leBucket{upperBound: upperBound, count: p.Value})
+		}
+	}
+
+	out := make([]AggregatePoint, 0, len(byTimestamp))
+	for ts, buckets := range byTimestamp {
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+		var cumulative float64
+		for i := range buckets {
+			cumulative += buckets[i].count
+			buckets[i].count = cumulative
+		}
+		out = append(out, AggregatePoint{Timestamp: ts, Value: histogramQuantile(quantile, buckets)})
+	}
+	return map[string][]AggregatePoint{"": out}
+}
+
+// parseLe parses a bucket's "le" label, the Prometheus convention for
+// spelling positive infinity as "+Inf".
+func parseLe(raw string) (float64, error) {
+	if raw == "+Inf" {
+		return math.Inf(1), nil
+	}
+	return strconv.ParseFloat(raw, 64)
+}
+
+// histogramQuantile estimates the given quantile from buckets, a
+// cumulative histogram sorted by ascending upperBound, by linearly
+// interpolating within the bucket the quantile's rank falls into. It
+// mirrors PromQL's histogram_quantile over a classic (non-native)
+// histogram.
+func histogramQuantile(quantile float64, buckets []leBucket) float64 {
+	if len(buckets) == 0 {
+		return math.NaN()
+	}
+	total := buckets[len(buckets)-1].count
+	if total <= 0 {
+		return math.NaN()
+	}
+	rank := quantile * total
+
+	var prevUpperBound, prevCount float64
+	for _, b := range buckets {
+		if b.count >= rank {
+			if math.IsInf(b.upperBound, 1) {
+				return prevUpperBound
+			}
+			if b.count == prevCount {
+				return b.upperBound
+			}
+			return prevUpperBound + (b.upperBound-prevUpperBound)*(rank-prevCount)/(b.count-prevCount)
+		}
+		prevUpperBound, prevCount = b.upperBound, b.count
+	}
+	return buckets[len(buckets)-1].upperBound
+}
+
+// computeAggregate folds one store's matching records into a partial
+// AggregateResult, ready to be Merged with every other store's partial
+// by the gateway node and then Finalized. It replays result through
+// EncodeTo rather than reaching into its internals, so it keeps working
+// however QueryResult ends up representing records.
+func computeAggregate(result QueryResult, spec AggregateSpec) (AggregateResult, error) {
+	rec := httptest.NewRecorder()
+	result.EncodeTo(rec)
+
+	agg := NewAggregateResult(spec)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		sp := strings.IndexByte(line, ' ')
+		if sp < 0 {
+			continue
+		}
+		id, err := ulid.ParseStrict(line[:sp])
+		if err != nil {
+			continue // not a record line; ignore stray output
+		}
+
+		key := ""
+		if spec.By != nil {
+			m := spec.By.FindStringSubmatch(line[sp+1:])
+			if m == nil {
+				continue
+			}
+			key = m[1]
+		}
+		agg.Add(key, ulid.Time(id.Time()), 1)
+	}
+	if err := scanner.Err(); err != nil {
+		return AggregateResult{}, errors.Wrap(err, "scanning records")
+	}
+	return agg, nil
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"math"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseAggregateSpecNoOp(t *testing.T) {
+	spec, err := ParseAggregateSpec(url.Values{})
+	if err != nil {
+		t.Fatalf("ParseAggregateSpec() error = %v", err)
+	}
+	if spec != nil {
+		t.Errorf("ParseAggregateSpec() = %+v, want nil", spec)
+	}
+}
+
+func TestParseAggregateSpecUnsupportedOp(t *testing.T) {
+	_, err := ParseAggregateSpec(url.Values{"aggregate": {"bogus"}})
+	if err == nil {
+		t.Error("ParseAggregateSpec() = nil error, want error for unsupported op")
+	}
+}
+
+func TestParseAggregateSpecK(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		k       string
+		wantErr bool
+		wantK   int
+	}{
+		{"default", "", false, 10},
+		{"positive", "5", false, 5},
+		{"zero rejected", "0", true, 0},
+		{"negative rejected", "-1", true, 0},
+		{"not a number", "abc", true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			values := url.Values{"aggregate": {"topk"}}
+			if tc.k != "" {
+				values.Set("k", tc.k)
+			}
+			spec, err := ParseAggregateSpec(values)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("ParseAggregateSpec() = nil error, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAggregateSpec() error = %v", err)
+			}
+			if spec.K != tc.wantK {
+				t.Errorf("K = %d, want %d", spec.K, tc.wantK)
+			}
+		})
+	}
+}
+
+func TestParseAggregateSpecHistogramQuantileRequiresBy(t *testing.T) {
+	_, err := ParseAggregateSpec(url.Values{"aggregate": {"histogram_quantile"}})
+	if err == nil {
+		t.Error("ParseAggregateSpec() = nil error, want error when by= is missing")
+	}
+}
+
+func TestAggregateResultAddBucketsByStep(t *testing.T) {
+	r := NewAggregateResult(AggregateSpec{Step: time.Minute})
+	base := time.Date(2026, 1, 1, 0, 0, 30, 0, time.UTC)
+
+	r.Add("", base, 1)
+	r.Add("", base.Add(10*time.Second), 1) // same minute bucket
+	r.Add("", base.Add(90*time.Second), 1) // the 00:02 bucket
+
+	points := r.Series[""]
+	if len(points) != 2 {
+		t.Fatalf("len(points) = %d, want 2", len(points))
+	}
+	if points[0].Value != 2 {
+		t.Errorf("points[0].Value = %v, want 2", points[0].Value)
+	}
+	if points[1].Value != 1 {
+		t.Errorf("points[1].Value = %v, want 1", points[1].Value)
+	}
+}
+
+func TestFinalizeCountCollapsesToInstantTotal(t *testing.T) {
+	spec := AggregateSpec{Op: AggregateCount, Step: time.Minute}
+	r := NewAggregateResult(spec)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.Add("a", base, 3)
+	r.Add("a", base.Add(time.Minute), 4)
+
+	r.Finalize(spec)
+
+	points := r.Series["a"]
+	if len(points) != 1 {
+		t.Fatalf("len(points) = %d, want 1 (count must collapse to one instant total)", len(points))
+	}
+	if points[0].Value != 7 {
+		t.Errorf("points[0].Value = %v, want 7", points[0].Value)
+	}
+}
+
+func TestFinalizeCountOverTimeKeepsBuckets(t *testing.T) {
+	spec := AggregateSpec{Op: AggregateCountOverTime, Step: time.Minute}
+	r := NewAggregateResult(spec)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.Add("a", base, 3)
+	r.Add("a", base.Add(time.Minute), 4)
+
+	r.Finalize(spec)
+
+	points := r.Series["a"]
+	if len(points) != 2 {
+		t.Fatalf("len(points) = %d, want 2 (count_over_time must keep per-step buckets)", len(points))
+	}
+}
+
+func TestFinalizeRateDividesBySeconds(t *testing.T) {
+	spec := AggregateSpec{Op: AggregateRate, Step: 10 * time.Second}
+	r := NewAggregateResult(spec)
+	r.Add("a", time.Unix(0, 0), 20)
+
+	r.Finalize(spec)
+
+	if got, want := r.Series["a"][0].Value, 2.0; got != want {
+		t.Errorf("rate value = %v, want %v", got, want)
+	}
+}
+
+func TestFinalizeTopKTrimsAndSorts(t *testing.T) {
+	spec := AggregateSpec{Op: AggregateTopK, Step: time.Minute, K: 2}
+	r := NewAggregateResult(spec)
+	base := time.Unix(0, 0)
+	r.Add("a", base, 5)
+	r.Add("a", base.Add(time.Minute), 1)
+	r.Add("a", base.Add(2*time.Minute), 9)
+
+	r.Finalize(spec)
+
+	points := r.Series["a"]
+	if len(points) != 2 {
+		t.Fatalf("len(points) = %d, want 2", len(points))
+	}
+	for _, p := range points {
+		if p.Value == 1 {
+			t.Errorf("topk kept the smallest value %v, want it trimmed", p.Value)
+		}
+	}
+}
+
+func TestAggregateResultMergeRejectsMismatchedOp(t *testing.T) {
+	a := NewAggregateResult(AggregateSpec{Op: AggregateCount})
+	b := NewAggregateResult(AggregateSpec{Op: AggregateRate})
+
+	if err := a.Merge(b); err == nil {
+		t.Error("Merge() = nil error, want error for mismatched Op")
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	buckets := []leBucket{
+		{upperBound: 1, count: 0},
+		{upperBound: 2, count: 50},
+		{upperBound: 4, count: 100},
+		{upperBound: math.Inf(1), count: 100},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		quantile float64
+		want     float64
+	}{
+		{"median lands exactly on the 1-2 bucket's upper bound", 0.5, 2},
+		{"p100 lands exactly on the 2-4 bucket's upper bound", 1.0, 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := histogramQuantile(tc.quantile, buckets)
+			if got != tc.want {
+				t.Errorf("histogramQuantile(%v) = %v, want %v", tc.quantile, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHistogramQuantileNoObservations(t *testing.T) {
+	got := histogramQuantile(0.5, []leBucket{{upperBound: 1, count: 0}})
+	if !math.IsNaN(got) {
+		t.Errorf("histogramQuantile() = %v, want NaN when there are no observations", got)
+	}
+}
+
+func TestParseLe(t *testing.T) {
+	if got, err := parseLe("+Inf"); err != nil || !math.IsInf(got, 1) {
+		t.Errorf("parseLe(+Inf) = (%v, %v), want (+Inf, nil)", got, err)
+	}
+	if got, err := parseLe("0.5"); err != nil || got != 0.5 {
+		t.Errorf("parseLe(0.5) = (%v, %v), want (0.5, nil)", got, err)
+	}
+	if _, err := parseLe("not-a-number"); err == nil {
+		t.Error("parseLe(not-a-number) = nil error, want error")
+	}
+}
@@ -1,13 +1,18 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -16,7 +21,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/oklog/oklog/pkg/cluster"
+	"github.com/oklog/oklog/pkg/rule"
 	"github.com/oklog/oklog/pkg/stream"
+	"github.com/oklog/ulid"
 )
 
 // These are the store API URL paths.
@@ -27,8 +34,133 @@ const (
 	APIPathInternalStream = "/_stream"
 	APIPathReplicate      = "/replicate"
 	APIPathClusterState   = "/_clusterstate"
+	APIPathRules          = "/rules"
+	APIPathAlerts         = "/alerts"
+	APIPathReloadRules    = "/_reload"
 )
 
+// Stream response formats, negotiated via the Accept header or a format=
+// query parameter on /stream and /_stream. streamFormatRaw preserves the
+// original newline-delimited behavior.
+const (
+	streamFormatRaw   = "raw"
+	streamFormatSSE   = "sse"
+	streamFormatJSONL = "jsonl"
+
+	streamQueryParamFormat = "format"
+	streamHeaderLastEvent  = "Last-Event-ID"
+	streamKeepaliveEvery   = 15 * time.Second
+)
+
+// negotiateStreamFormat determines which wire format to use for a stream
+// response. The format= query parameter takes precedence over the Accept
+// header, since it's easier for non-browser clients to set explicitly.
+func negotiateStreamFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get(streamQueryParamFormat)) {
+	case streamFormatSSE:
+		return streamFormatSSE
+	case streamFormatJSONL, "json":
+		return streamFormatJSONL
+	case streamFormatRaw:
+		return streamFormatRaw
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		switch strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]) {
+		case "text/event-stream":
+			return streamFormatSSE
+		case "application/x-ndjson", "application/jsonl":
+			return streamFormatJSONL
+		}
+	}
+	return streamFormatRaw
+}
+
+// resumeFromLastEventID maps an incoming Last-Event-ID header, as sent by
+// EventSource on reconnect, to the ULID offset query parameters understood
+// by MakeQueryParams. We only fill in "from" if the client didn't already
+// specify one explicitly.
+func resumeFromLastEventID(r *http.Request) url.Values {
+	values := r.URL.Query()
+	if id := r.Header.Get(streamHeaderLastEvent); id != "" && values.Get("from") == "" {
+		values.Set("from", id)
+	}
+	return values
+}
+
+// streamRecordWriter writes successive stream records to w in the
+// negotiated format. For SSE it tags each event with the record's own
+// leading ULID as the event id, so a reconnecting client's
+// Last-Event-ID is a real offset resumeFromLastEventID can feed back
+// into MakeQueryParams as from=.
+type streamRecordWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	format  string
+}
+
+func newStreamRecordWriter(w http.ResponseWriter, flusher http.Flusher, format string) *streamRecordWriter {
+	switch format {
+	case streamFormatSSE:
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+	case streamFormatJSONL:
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	}
+	return &streamRecordWriter{w: w, flusher: flusher, format: format}
+}
+
+// recordEventID returns the ULID record starts with, formatted for use
+// as an SSE event id, or "" if record doesn't start with one (in which
+// case writeRecord omits the id: line rather than invent a value that
+// can't be resumed from).
+func recordEventID(record []byte) string {
+	sp := bytes.IndexByte(record, ' ')
+	if sp < 0 {
+		return ""
+	}
+	if _, err := ulid.ParseStrict(string(record[:sp])); err != nil {
+		return ""
+	}
+	return string(record[:sp])
+}
+
+func (s *streamRecordWriter) writeRecord(record []byte) {
+	switch s.format {
+	case streamFormatSSE:
+		if id := recordEventID(record); id != "" {
+			fmt.Fprintf(s.w, "id: %s\n", id)
+		}
+		fmt.Fprintf(s.w, "data: %s\n\n", record)
+	case streamFormatJSONL:
+		// No source field: neither stream.Execute's merged records nor
+		// a.log.Stream's local ones carry per-record peer provenance,
+		// so there's nothing honest to put there.
+		buf, err := json.Marshal(struct {
+			TS     time.Time `json:"ts"`
+			Record string    `json:"record"`
+		}{
+			TS:     time.Now().UTC(),
+			Record: string(record),
+		})
+		if err != nil {
+			return
+		}
+		s.w.Write(append(buf, '\n'))
+	default:
+		s.w.Write(append(record, '\n'))
+	}
+	s.flusher.Flush()
+}
+
+func (s *streamRecordWriter) writeKeepalive() {
+	if s.format != streamFormatSSE {
+		return
+	}
+	fmt.Fprint(s.w, ": keepalive\n\n")
+	s.flusher.Flush()
+}
+
 // API serves the store API.
 type API struct {
 	peer               *cluster.Peer
@@ -38,9 +170,78 @@ type API struct {
 	replicatedBytes    prometheus.Counter
 	duration           *prometheus.HistogramVec
 	logger             log.Logger
+	rules              *rule.Manager
+	maxQueryTimeout    time.Duration
+	auth               Authenticator
+	clusterAuth        ClusterAuthenticator
+	transport          InternalTransport
+}
+
+// headerRoundTripper sets a fixed set of headers on every outgoing
+// request before delegating to next (http.DefaultTransport if next is
+// nil, matching http.Client's own zero-value behavior). It's how
+// handleUserStream attaches the cluster credential and tenant to
+// requests made through stream.HTTPReaderFactory, which takes only an
+// *http.Client and has no other hook for setting headers.
+type headerRoundTripper struct {
+	headers http.Header
+	next    http.RoundTripper
 }
 
-// NewAPI returns a usable API.
+func (h headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	cloned := new(http.Request)
+	*cloned = *req
+	cloned.Header = make(http.Header, len(req.Header))
+	for k, vs := range req.Header {
+		cloned.Header[k] = vs
+	}
+	for k, vs := range h.headers {
+		for _, v := range vs {
+			cloned.Header.Set(k, v)
+		}
+	}
+
+	next := h.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(cloned)
+}
+
+// InternalTransport is the pluggable backend for internal peer-to-peer
+// query and stream fan-out, letting operators swap the default HTTP
+// calls for a lower-overhead transport without changing handleUserQuery
+// or handleUserStream themselves. pkg/store/grpc.Client is the gRPC
+// implementation; pass one as NewAPI's transport argument to use it.
+// Wiring that choice to a command-line flag is the binary entrypoint's
+// job and lives outside this package.
+type InternalTransport interface {
+	// Query fetches hostport's full partial QueryResult for query,
+	// including matching records, not just error/duration stats.
+	Query(ctx context.Context, hostport string, query QueryParams) (QueryResult, error)
+
+	// Stream returns a channel of hostport's matching records as they
+	// arrive, closed when hostport's stream ends or ctx is done.
+	Stream(ctx context.Context, hostport string, query QueryParams) (<-chan []byte, error)
+}
+
+// NewAPI returns a usable API. maxQueryTimeout caps the timeout= query
+// parameter clients may request on /query; zero means no server-imposed
+// cap. auth authenticates user-facing requests and is consulted before
+// dispatch; a nil auth falls back to AllowAll. clusterToken, if set,
+// gates the internal peer-to-peer endpoints with a separate credential.
+//
+// auth's tenant both gates who may call the API and scopes what they
+// see: since QueryParams and the segment writer have no Tenant
+// dimension of their own, records are tagged with their tenant at
+// replication time (see taggedReader) and a.log.Query/a.log.Stream's
+// results are narrowed back down to the caller's tenant before they're
+// returned or merged with another store's partial result (see
+// filterQueryResultByTenant, stripTenantTag). The one gap: records
+// replicated over the gRPC transport (pkg/store/grpc.Server.Replicate)
+// aren't tagged, since a Replicate stream's Record chunks don't align
+// with record boundaries the way Query/Stream's do, so gRPC-replicated
+// segments are visible only to DefaultTenant until that's solved.
 func NewAPI(
 	peer *cluster.Peer,
 	log Log,
@@ -48,8 +249,17 @@ func NewAPI(
 	replicatedSegments, replicatedBytes prometheus.Counter,
 	duration *prometheus.HistogramVec,
 	logger log.Logger,
-) *API {
-	return &API{
+	maxQueryTimeout time.Duration,
+	auth Authenticator,
+	clusterToken string,
+	transport InternalTransport,
+	rulesFile string,
+	alertWebhookURL string,
+) (*API, error) {
+	if auth == nil {
+		auth = AllowAll{}
+	}
+	a := &API{
 		peer:               peer,
 		log:                log,
 		client:             client,
@@ -57,6 +267,28 @@ func NewAPI(
 		replicatedBytes:    replicatedBytes,
 		duration:           duration,
 		logger:             logger,
+		maxQueryTimeout:    maxQueryTimeout,
+		auth:               auth,
+		clusterAuth:        ClusterAuthenticator{Token: clusterToken},
+		transport:          transport,
+	}
+	rules, err := rule.NewManager(rulesFile, a.countMatches, alertWebhookURL, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading rules")
+	}
+	a.rules = rules
+	return a, nil
+}
+
+// isInternalPath reports whether path is one of the peer-to-peer
+// endpoints, which are gated by the cluster credential instead of the
+// user Authenticator.
+func isInternalPath(path string) bool {
+	switch path {
+	case APIPathInternalQuery, APIPathInternalStream, APIPathReplicate, APIPathClusterState:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -72,6 +304,21 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}(time.Now())
 
 	method, path := r.Method, r.URL.Path
+
+	if isInternalPath(path) {
+		if err := a.clusterAuth.Authenticate(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	} else {
+		claims, err := a.auth.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r = r.WithContext(withTenant(r.Context(), claims.Tenant))
+	}
+
 	switch {
 	case method == "GET" && path == "/":
 		r.URL.Path = APIPathUserQuery
@@ -92,6 +339,12 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		a.handleReplicate(w, r)
 	case method == "GET" && path == APIPathClusterState:
 		a.handleClusterState(w, r)
+	case method == "GET" && path == APIPathRules:
+		a.handleRules(w, r)
+	case method == "GET" && path == APIPathAlerts:
+		a.handleAlerts(w, r)
+	case method == "POST" && path == APIPathReloadRules:
+		a.handleReloadRules(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -107,6 +360,23 @@ func (iw *interceptingWriter) WriteHeader(code int) {
 	iw.ResponseWriter.WriteHeader(code)
 }
 
+// queryPeerStat records the outcome of one peer's sub-request, for the
+// X-Oklog-Peer-Stats debugging header.
+type queryPeerStat struct {
+	Peer     string `json:"peer"`
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+}
+
+// queryResponse is one peer's raw sub-request outcome, gathered by
+// handleUserQuery before it's merged or turned into a queryPeerStat.
+type queryResponse struct {
+	hostport string
+	result   QueryResult
+	err      error
+	duration time.Duration
+}
+
 func (a *API) handleUserQuery(w http.ResponseWriter, r *http.Request, statsOnly bool) {
 	begin := time.Now()
 
@@ -122,79 +392,295 @@ func (a *API) handleUserQuery(w http.ResponseWriter, r *http.Request, statsOnly
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	partial := r.URL.Query().Get("partial") == "true"
+
+	ctx := r.Context()
+	if timeout, ok := parseQueryTimeout(r.URL.Query().Get("timeout"), a.maxQueryTimeout); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
 	method := "GET"
 	if statsOnly {
 		method = "HEAD"
 	}
 
-	var requests []*http.Request
+	spec, err := ParseAggregateSpec(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if spec != nil {
+		a.handleUserAggregateQuery(ctx, w, query, *spec, members, partial)
+		return
+	}
+
+	c := make(chan queryResponse, len(members))
 	for _, hostport := range members {
-		u, err := url.Parse(fmt.Sprintf("http://%s/store%s", hostport, APIPathInternalQuery))
-		if err != nil {
-			err = errors.Wrapf(err, "constructing URL for %s", hostport)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		go func(hostport string) {
+			start := time.Now()
+			result, err := a.queryPeer(ctx, hostport, query, method)
+			c <- queryResponse{hostport, result, err, time.Since(start)}
+		}(hostport)
+	}
+
+	result := QueryResult{Params: query}
+	stats := make([]queryPeerStat, 0, len(members))
+gather:
+	for received := 0; received < cap(c); received++ {
+		select {
+		case resp := <-c:
+			stats = append(stats, a.mergeQueryResponse(&result, resp))
+		case <-ctx.Done():
+			dropped := cap(c) - received
+			result.ErrorCount += dropped
+			stats = append(stats, queryPeerStat{Status: fmt.Sprintf("%d peer(s) dropped: %v", dropped, ctx.Err())})
+			go drainQueryResponses(c, dropped)
+			if !partial {
+				http.Error(w, ctx.Err().Error(), http.StatusGatewayTimeout)
+				return
+			}
+			break gather
 		}
-		query.EncodeTo(u.Query()) // use query directly, no translation needed
-		req, err := http.NewRequest(method, u.String(), nil)
+	}
+
+	if buf, err := json.Marshal(stats); err == nil {
+		w.Header().Set("X-Oklog-Peer-Stats", string(buf))
+	}
+	result.Duration = time.Since(begin).String()
+	result.EncodeTo(w)
+}
+
+// queryPeer fetches one peer's partial query result, using
+// a.transport when configured (see InternalTransport) or falling back
+// to the internal HTTP endpoint otherwise.
+func (a *API) queryPeer(ctx context.Context, hostport string, query QueryParams, method string) (QueryResult, error) {
+	if a.transport != nil {
+		return a.transport.Query(ctx, hostport, query)
+	}
+
+	u, err := url.Parse(fmt.Sprintf("http://%s/store%s", hostport, APIPathInternalQuery))
+	if err != nil {
+		return QueryResult{}, errors.Wrapf(err, "constructing URL for %s", hostport)
+	}
+	query.EncodeTo(u.Query()) // use query directly, no translation needed
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return QueryResult{}, errors.Wrapf(err, "constructing request for %s", hostport)
+	}
+	req.Header.Set(HeaderTenant, tenantFromContext(ctx))
+	req.Header.Set("Authorization", "Bearer "+a.clusterAuth.Token)
+	req = req.WithContext(ctx)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			err = errors.Wrapf(err, "constructing request for %s", hostport)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			buf = []byte(err.Error())
+		}
+		if len(buf) == 0 {
+			buf = []byte("unknown")
 		}
-		requests = append(requests, req)
+		return QueryResult{}, errors.Errorf("http %d: %s", resp.StatusCode, strings.TrimSpace(string(buf)))
 	}
 
-	type response struct {
-		resp *http.Response
-		err  error
+	var result QueryResult
+	result.DecodeFrom(resp)
+	return result, nil
+}
+
+// mergeQueryResponse folds one peer's query outcome into result and
+// returns a stat describing it, logging any failure the same way the
+// original sequential gather loop did.
+func (a *API) mergeQueryResponse(result *QueryResult, resp queryResponse) queryPeerStat {
+	stat := queryPeerStat{Peer: resp.hostport, Duration: resp.duration.String()}
+
+	if resp.err != nil {
+		level.Error(a.logger).Log("during", "query_gather", "err", resp.err)
+		result.ErrorCount++
+		stat.Status = "error: " + resp.err.Error()
+		return stat
 	}
-	c := make(chan response, len(requests))
-	for _, req := range requests {
-		go func(req *http.Request) {
-			// TODO(pb): don't use http.DefaultClient
-			resp, err := http.DefaultClient.Do(req)
-			c <- response{resp, err}
-		}(req)
+
+	if err := result.Merge(resp.result); err != nil {
+		level.Error(a.logger).Log("during", "query_gather", "err", errors.Wrap(err, "merging results"))
+		result.ErrorCount++
+		stat.Status = "error: merging results: " + err.Error()
+		return stat
+	}
+	stat.Status = "ok"
+	return stat
+}
+
+// aggregateResponse is one peer's raw aggregate sub-request outcome,
+// gathered by handleUserAggregateQuery before it's merged or turned
+// into a queryPeerStat.
+type aggregateResponse struct {
+	hostport string
+	result   AggregateResult
+	err      error
+	duration time.Duration
+}
+
+// handleUserAggregateQuery is handleUserQuery's counterpart for
+// aggregate= requests: it fans the same query plus spec out to every
+// store peer, merges their partial AggregateResults, and Finalizes the
+// merged result instead of writing out raw records.
+func (a *API) handleUserAggregateQuery(ctx context.Context, w http.ResponseWriter, query QueryParams, spec AggregateSpec, members []string, partial bool) {
+	c := make(chan aggregateResponse, len(members))
+	for _, hostport := range members {
+		go func(hostport string) {
+			start := time.Now()
+			result, err := a.queryPeerAggregate(ctx, hostport, query, spec)
+			c <- aggregateResponse{hostport, result, err, time.Since(start)}
+		}(hostport)
+	}
+
+	result := NewAggregateResult(spec)
+	stats := make([]queryPeerStat, 0, len(members))
+gather:
+	for received := 0; received < cap(c); received++ {
+		select {
+		case resp := <-c:
+			stats = append(stats, a.mergeAggregateResponse(&result, resp))
+		case <-ctx.Done():
+			dropped := cap(c) - received
+			result.ErrorCount += dropped
+			stats = append(stats, queryPeerStat{Status: fmt.Sprintf("%d peer(s) dropped: %v", dropped, ctx.Err())})
+			go drainAggregateResponses(c, dropped)
+			if !partial {
+				http.Error(w, ctx.Err().Error(), http.StatusGatewayTimeout)
+				return
+			}
+			break gather
+		}
 	}
+	result.Finalize(spec)
 
-	responses := make([]response, cap(c))
-	for i := 0; i < cap(c); i++ {
-		responses[i] = <-c
+	if buf, err := json.Marshal(stats); err == nil {
+		w.Header().Set("X-Oklog-Peer-Stats", string(buf))
 	}
-	result := QueryResult{
-		Params: query,
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// queryPeerAggregate fetches one peer's partial AggregateResult over
+// the internal query endpoint, the aggregate= analogue of queryPeer.
+func (a *API) queryPeerAggregate(ctx context.Context, hostport string, query QueryParams, spec AggregateSpec) (AggregateResult, error) {
+	u, err := url.Parse(fmt.Sprintf("http://%s/store%s", hostport, APIPathInternalQuery))
+	if err != nil {
+		return AggregateResult{}, errors.Wrapf(err, "constructing URL for %s", hostport)
 	}
-	for _, response := range responses {
-		if response.err != nil {
-			level.Error(a.logger).Log("during", "query_gather", "err", response.err)
-			result.ErrorCount++
-			continue
+	values := u.Query()
+	query.EncodeTo(values)
+	values.Set("aggregate", string(spec.Op))
+	values.Set("step", spec.Step.String())
+	if spec.By != nil {
+		values.Set("by", spec.By.String())
+	}
+	values.Set("k", strconv.Itoa(spec.K))
+	values.Set("quantile", strconv.FormatFloat(spec.Quantile, 'f', -1, 64))
+	u.RawQuery = values.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return AggregateResult{}, errors.Wrapf(err, "constructing request for %s", hostport)
+	}
+	req.Header.Set(HeaderTenant, tenantFromContext(ctx))
+	req.Header.Set("Authorization", "Bearer "+a.clusterAuth.Token)
+	req = req.WithContext(ctx)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return AggregateResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			buf = []byte(err.Error())
 		}
-		if response.resp.StatusCode != http.StatusOK {
-			buf, err := ioutil.ReadAll(response.resp.Body)
-			if err != nil {
-				buf = []byte(err.Error())
-			}
-			if len(buf) == 0 {
-				buf = []byte("unknown")
-			}
-			response.resp.Body.Close()
-			level.Error(a.logger).Log("during", "query_gather", "status_code", response.resp.StatusCode, "err", strings.TrimSpace(string(buf)))
-			result.ErrorCount++
-			continue
+		if len(buf) == 0 {
+			buf = []byte("unknown")
 		}
-		var partialResult QueryResult
-		partialResult.DecodeFrom(response.resp)
-		if err := result.Merge(partialResult); err != nil {
-			err = errors.Wrap(err, "merging results")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		return AggregateResult{}, errors.Errorf("http %d: %s", resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+
+	var result AggregateResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return AggregateResult{}, errors.Wrap(err, "decoding aggregate result")
+	}
+	return result, nil
+}
+
+// mergeAggregateResponse folds one peer's aggregate outcome into result
+// and returns a stat describing it, mirroring mergeQueryResponse.
+func (a *API) mergeAggregateResponse(result *AggregateResult, resp aggregateResponse) queryPeerStat {
+	stat := queryPeerStat{Peer: resp.hostport, Duration: resp.duration.String()}
+
+	if resp.err != nil {
+		level.Error(a.logger).Log("during", "aggregate_query_gather", "err", resp.err)
+		result.ErrorCount++
+		stat.Status = "error: " + resp.err.Error()
+		return stat
+	}
+
+	if err := result.Merge(resp.result); err != nil {
+		level.Error(a.logger).Log("during", "aggregate_query_gather", "err", errors.Wrap(err, "merging results"))
+		result.ErrorCount++
+		stat.Status = "error: merging results: " + err.Error()
+		return stat
+	}
+	stat.Status = "ok"
+	return stat
+}
+
+// drainAggregateResponses reads and discards n more responses from c so
+// the peer goroutines left behind by a timed-out or canceled gather
+// don't block forever trying to send.
+func drainAggregateResponses(c <-chan aggregateResponse, n int) {
+	for i := 0; i < n; i++ {
+		<-c
+	}
+}
+
+// drainQueryResponses reads and discards n more responses from c so the
+// peer goroutines left behind by a timed-out or canceled gather don't
+// block forever trying to send.
+func drainQueryResponses(c <-chan queryResponse, n int) {
+	for i := 0; i < n; i++ {
+		<-c
+	}
+}
+
+// parseQueryTimeout parses the timeout= query parameter, clamping it to
+// max if both are set and positive. It reports ok=false when no timeout
+// should be applied at all.
+func parseQueryTimeout(raw string, max time.Duration) (time.Duration, bool) {
+	var requested time.Duration
+	if raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err == nil && d > 0 {
+			requested = d
 		}
 	}
-	result.Duration = time.Since(begin).String()
-	result.EncodeTo(w)
+	switch {
+	case requested > 0 && max > 0 && requested > max:
+		return max, true
+	case requested > 0:
+		return requested, true
+	case max > 0:
+		return max, true
+	default:
+		return 0, false
+	}
 }
 
 func (a *API) handleInternalQuery(w http.ResponseWriter, r *http.Request, statsOnly bool) {
@@ -204,17 +690,50 @@ func (a *API) handleInternalQuery(w http.ResponseWriter, r *http.Request, statsO
 		return
 	}
 
+	// tenant is the caller's validated tenant, forwarded by the gateway
+	// node's handleUserQuery. Since QueryParams has no Tenant dimension
+	// of its own, a.log.Query still returns every tenant's matches;
+	// filterQueryResultByTenant narrows that down to tenant's own
+	// records (tagged at replication time by taggedReader) before
+	// anything is returned or merged with another store's result.
+	tenant := r.Header.Get(HeaderTenant)
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	level.Debug(a.logger).Log("during", "internal_query", "tenant", tenant)
+
 	result, err := a.log.Query(query, statsOnly)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	result, err = filterQueryResultByTenant(result, tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	spec, err := ParseAggregateSpec(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if spec != nil {
+		partial, err := computeAggregate(result, *spec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(partial)
+		return
+	}
 
 	result.EncodeTo(w)
 }
 
 func (a *API) handleUserStream(w http.ResponseWriter, r *http.Request) {
-	query, err := MakeQueryParams(r.URL.Query())
+	query, err := MakeQueryParams(resumeFromLastEventID(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -225,43 +744,102 @@ func (a *API) handleUserStream(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "can't stream to your client", http.StatusPreconditionFailed)
 		return
 	}
+	out := newStreamRecordWriter(w, flusher, negotiateStreamFormat(r))
 
-	peerFactory := func() []string {
-		return a.peer.Current(cluster.PeerTypeStore)
-	}
+	records := make(chan []byte)
+	if a.transport != nil {
+		go a.streamViaTransport(r.Context(), query, records)
+	} else {
+		peerFactory := func() []string {
+			return a.peer.Current(cluster.PeerTypeStore)
+		}
 
-	readerFactory := stream.HTTPReaderFactory(a.client, func(addr string) string {
-		u, err := url.Parse(fmt.Sprintf("http://%s/store%s", addr, APIPathInternalStream))
-		if err != nil {
-			panic(err)
+		// stream.HTTPReaderFactory has no hook for setting headers on the
+		// requests it makes, so the cluster credential and tenant that
+		// isInternalPath/handleInternalStream require have to ride in on
+		// a.client's Transport instead.
+		streamClient := &http.Client{
+			Timeout: a.client.Timeout,
+			Transport: headerRoundTripper{
+				next: a.client.Transport,
+				headers: http.Header{
+					"Authorization": []string{"Bearer " + a.clusterAuth.Token},
+					HeaderTenant:    []string{tenantFromContext(r.Context())},
+				},
+			},
 		}
-		query.EncodeTo(u.Query())
-		return u.String()
-	})
 
-	records := make(chan []byte)
-	go stream.Execute(
-		r.Context(),
-		peerFactory,
-		readerFactory,
-		records,
-		time.Sleep,
-		time.NewTicker,
-	)
+		readerFactory := stream.HTTPReaderFactory(streamClient, func(addr string) string {
+			u, err := url.Parse(fmt.Sprintf("http://%s/store%s", addr, APIPathInternalStream))
+			if err != nil {
+				panic(err)
+			}
+			query.EncodeTo(u.Query())
+			return u.String()
+		})
+
+		go stream.Execute(
+			r.Context(),
+			peerFactory,
+			readerFactory,
+			records,
+			time.Sleep,
+			time.NewTicker,
+		)
+	}
 
+	keepalive := time.NewTicker(streamKeepaliveEvery)
+	defer keepalive.Stop()
 	for {
 		select {
 		case record := <-records:
-			w.Write(append(record, '\n'))
-			flusher.Flush()
+			out.writeRecord(record)
+		case <-keepalive.C:
+			out.writeKeepalive()
 		case <-r.Context().Done():
 			return
 		}
 	}
 }
 
+// streamViaTransport fans query out to every current store peer over
+// a.transport instead of stream.Execute's HTTP reader factory, merging
+// each peer's records into out until ctx is done or every peer's stream
+// ends. Unlike the HTTP path, it snapshots peer membership once at call
+// time rather than re-polling for peers that join mid-stream.
+func (a *API) streamViaTransport(ctx context.Context, query QueryParams, out chan<- []byte) {
+	var wg sync.WaitGroup
+	for _, hostport := range a.peer.Current(cluster.PeerTypeStore) {
+		records, err := a.transport.Stream(ctx, hostport, query)
+		if err != nil {
+			level.Error(a.logger).Log("during", "stream_gather", "peer", hostport, "err", err)
+			continue
+		}
+		wg.Add(1)
+		go func(records <-chan []byte) {
+			defer wg.Done()
+			for {
+				select {
+				case record, ok := <-records:
+					if !ok {
+						return
+					}
+					select {
+					case out <- record:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(records)
+	}
+	wg.Wait()
+}
+
 func (a *API) handleInternalStream(w http.ResponseWriter, r *http.Request) {
-	query, err := MakeQueryParams(r.URL.Query())
+	query, err := MakeQueryParams(resumeFromLastEventID(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -272,6 +850,12 @@ func (a *API) handleInternalStream(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "can't stream to your client", http.StatusPreconditionFailed)
 		return
 	}
+	out := newStreamRecordWriter(w, flusher, negotiateStreamFormat(r))
+
+	tenant := r.Header.Get(HeaderTenant)
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
 
 	records := a.log.Stream(r.Context(), query)
 	if err != nil {
@@ -279,44 +863,74 @@ func (a *API) handleInternalStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keepalive := time.NewTicker(streamKeepaliveEvery)
+	defer keepalive.Stop()
 	for {
 		select {
 		case <-r.Context().Done():
 			return // the cancelation is transitive, just need to return
 
 		case record := <-records:
-			fmt.Fprintf(w, "%s\n", record)
-			flusher.Flush()
+			// See filterQueryResultByTenant's comment: records are
+			// tagged at replication time, so a.log.Stream returns every
+			// tenant's matches and must be narrowed down here.
+			if stripped, ok := stripTenantTag(record, tenant); ok {
+				out.writeRecord(stripped)
+			}
+
+		case <-keepalive.C:
+			out.writeKeepalive()
 		}
 	}
 }
 
 func (a *API) handleReplicate(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	segment, err := a.log.Create()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+
+	tenant := r.Header.Get(HeaderTenant)
+	if tenant == "" {
+		tenant = DefaultTenant
 	}
-	low, high, n, err := mergeRecords(segment, r.Body)
+	level.Debug(a.logger).Log("during", "replicate", "tenant", tenant)
+
+	n, err := a.ReplicateRecords(taggedReader(r.Body, tenant))
 	if err != nil {
-		segment.Delete()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	} else if n == 0 {
-		segment.Delete()
 		fmt.Fprintln(w, "No records")
 		return
 	}
-	if err := segment.Close(low, high); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 	a.replicatedSegments.Inc()
 	a.replicatedBytes.Add(float64(n))
 	fmt.Fprintln(w, "OK")
 }
 
+// ReplicateRecords merges raw newline-delimited records read from r
+// into a new segment and closes it. It's the replication path
+// handleReplicate uses over HTTP, without the tenant tagging
+// handleReplicate applies to the body first. It's exported so alternate
+// transports (see pkg/store/grpc) can reuse the same replication path.
+func (a *API) ReplicateRecords(r io.Reader) (n int, err error) {
+	segment, err := a.log.Create()
+	if err != nil {
+		return 0, err
+	}
+	low, high, n, err := mergeRecords(segment, r)
+	if err != nil {
+		segment.Delete()
+		return 0, err
+	}
+	if n == 0 {
+		segment.Delete()
+		return 0, nil
+	}
+	if err := segment.Close(low, high); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (a *API) handleClusterState(w http.ResponseWriter, r *http.Request) {
 	buf, err := json.MarshalIndent(a.peer.State(), "", "    ")
 	if err != nil {
@@ -326,3 +940,106 @@ func (a *API) handleClusterState(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Write(buf)
 }
+
+// RunRules evaluates alerting rule groups on their configured intervals
+// until ctx is done. Callers should start it once, alongside ServeHTTP.
+func (a *API) RunRules(ctx context.Context) {
+	a.rules.Run(ctx)
+}
+
+func (a *API) handleRules(w http.ResponseWriter, r *http.Request) {
+	buf, err := json.MarshalIndent(a.rules.Groups(), "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf)
+}
+
+func (a *API) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	buf, err := json.MarshalIndent(a.rules.Alerts(), "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf)
+}
+
+func (a *API) handleReloadRules(w http.ResponseWriter, r *http.Request) {
+	if err := a.rules.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// countMatches implements rule.QueryFunc by fanning a counting query out
+// to every store peer, mirroring the merge pattern handleUserQuery uses
+// for full query results.
+func (a *API) countMatches(ctx context.Context, pattern string, window time.Duration) (int, error) {
+	members := a.peer.Current(cluster.PeerTypeStore)
+	if len(members) <= 0 {
+		return 0, errors.New("no store nodes available")
+	}
+
+	values := url.Values{}
+	values.Set("q", pattern)
+	values.Set("from", ulid.MustNew(ulid.Timestamp(time.Now().Add(-window)), nil).String())
+	values.Set("to", ulid.MustNew(ulid.Timestamp(time.Now()), nil).String())
+	query, err := MakeQueryParams(values)
+	if err != nil {
+		return 0, errors.Wrap(err, "building rule query")
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total int
+	)
+	for _, hostport := range members {
+		u, err := url.Parse(fmt.Sprintf("http://%s/store%s", hostport, APIPathInternalQuery))
+		if err != nil {
+			continue
+		}
+		query.EncodeTo(u.Query())
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set(HeaderTenant, tenantFromContext(ctx))
+		req.Header.Set("Authorization", "Bearer "+a.clusterAuth.Token)
+		req = req.WithContext(ctx)
+
+		wg.Add(1)
+		go func(req *http.Request) {
+			defer wg.Done()
+			resp, err := a.client.Do(req)
+			if err != nil {
+				level.Error(a.logger).Log("during", "rule_query", "err", err)
+				return
+			}
+			defer resp.Body.Close()
+			n, err := countLines(resp.Body)
+			if err != nil {
+				level.Error(a.logger).Log("during", "rule_query", "err", err)
+				return
+			}
+			mu.Lock()
+			total += n
+			mu.Unlock()
+		}(req)
+	}
+	wg.Wait()
+	return total, nil
+}
+
+func countLines(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	var n int
+	for scanner.Scan() {
+		n++
+	}
+	return n, scanner.Err()
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+func TestRecordEventID(t *testing.T) {
+	id := ulid.MustNew(ulid.Timestamp(time.Now()), nil)
+
+	for _, tc := range []struct {
+		name   string
+		record []byte
+		want   string
+	}{
+		{"well-formed record", []byte(id.String() + " hello world"), id.String()},
+		{"no space", []byte("nospacehere"), ""},
+		{"malformed id", []byte("not-a-ulid hello"), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := recordEventID(tc.record); got != tc.want {
+				t.Errorf("recordEventID(%q) = %q, want %q", tc.record, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResumeFromLastEventID(t *testing.T) {
+	id := ulid.MustNew(ulid.Timestamp(time.Now()), nil)
+
+	r := httptest.NewRequest("GET", "/stream", nil)
+	r.Header.Set(streamHeaderLastEvent, id.String())
+
+	values := resumeFromLastEventID(r)
+	if got := values.Get("from"); got != id.String() {
+		t.Errorf("from = %q, want %q", got, id.String())
+	}
+}
+
+func TestResumeFromLastEventIDDoesNotOverrideExplicitFrom(t *testing.T) {
+	id := ulid.MustNew(ulid.Timestamp(time.Now()), nil)
+	explicit := ulid.MustNew(ulid.Timestamp(time.Now().Add(-time.Hour)), nil)
+
+	r := httptest.NewRequest("GET", "/stream?from="+explicit.String(), nil)
+	r.Header.Set(streamHeaderLastEvent, id.String())
+
+	values := resumeFromLastEventID(r)
+	if got := values.Get("from"); got != explicit.String() {
+		t.Errorf("from = %q, want explicit %q", got, explicit.String())
+	}
+}
+
+func TestParseQueryTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		raw    string
+		max    time.Duration
+		want   time.Duration
+		wantOK bool
+	}{
+		{"no timeout, no max", "", 0, 0, false},
+		{"no timeout, server max applies", "", 5 * time.Second, 5 * time.Second, true},
+		{"client timeout under max", "2s", 5 * time.Second, 2 * time.Second, true},
+		{"client timeout clamped to max", "10s", 5 * time.Second, 5 * time.Second, true},
+		{"client timeout, no server max", "2s", 0, 2 * time.Second, true},
+		{"invalid duration ignored", "not-a-duration", 5 * time.Second, 5 * time.Second, true},
+		{"negative duration ignored", "-1s", 5 * time.Second, 5 * time.Second, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseQueryTimeout(tc.raw, tc.max)
+			if ok != tc.wantOK || got != tc.want {
+				t.Errorf("parseQueryTimeout(%q, %s) = (%s, %v), want (%s, %v)", tc.raw, tc.max, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// DefaultTenant is the tenant assigned to requests when no Authenticator
+// is configured, preserving the historical open-by-default behavior.
+const DefaultTenant = "default"
+
+// HeaderTenant carries the validated tenant on internal peer-to-peer
+// sub-requests, so a store node doesn't need to re-authenticate the
+// original caller to know which tenant a fan-out request belongs to.
+const HeaderTenant = "X-Oklog-Tenant"
+
+// Claims describes the validated identity behind an inbound user
+// request, as established by an Authenticator.
+type Claims struct {
+	Subject string
+	Tenant  string
+}
+
+// Authenticator validates an inbound user request and returns the
+// Claims it carries, or an error if the request isn't authenticated.
+// The tenant on the returned Claims is trusted; it is never taken
+// directly from user-controlled query parameters.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Claims, error)
+}
+
+// AllowAll is a no-op Authenticator that accepts every request under
+// DefaultTenant. It's what NewAPI falls back to when callers don't pass
+// one, so existing single-tenant deployments keep working unchanged.
+type AllowAll struct{}
+
+// Authenticate implements Authenticator.
+func (AllowAll) Authenticate(r *http.Request) (Claims, error) {
+	return Claims{Tenant: DefaultTenant}, nil
+}
+
+// bearerToken extracts the token from a standard "Authorization: Bearer
+// <token>" header, returning "" if the header is absent or malformed.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(h, prefix)
+}
+
+// BearerJWTAuthenticator validates JWT bearer tokens via Keyfunc, built
+// with JWKSKeyfunc (a cached JWKS endpoint, RSA or Ed25519 keys) or
+// Ed25519Keyfunc (a single fixed Ed25519 public key) for the common
+// cases; both guard against alg confusion by checking the token's
+// signing method against the resolved key's own type. The tenant is
+// read from TenantClaim (default "tenant").
+type BearerJWTAuthenticator struct {
+	Keyfunc     jwt.Keyfunc
+	TenantClaim string
+}
+
+// Authenticate implements Authenticator.
+func (b BearerJWTAuthenticator) Authenticate(r *http.Request) (Claims, error) {
+	raw := bearerToken(r)
+	if raw == "" {
+		return Claims{}, errors.New("missing bearer token")
+	}
+
+	token, err := jwt.Parse(raw, b.Keyfunc)
+	if err != nil || !token.Valid {
+		return Claims{}, errors.Wrap(err, "invalid bearer token")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return Claims{}, errors.New("invalid token claims")
+	}
+
+	tenantClaim := b.TenantClaim
+	if tenantClaim == "" {
+		tenantClaim = "tenant"
+	}
+	tenant, _ := claims[tenantClaim].(string)
+	if tenant == "" {
+		return Claims{}, errors.Errorf("token missing %q claim", tenantClaim)
+	}
+	subject, _ := claims["sub"].(string)
+	return Claims{Subject: subject, Tenant: tenant}, nil
+}
+
+// ClientCertAuthenticator authenticates via the TLS client certificate
+// presented on a mutual-TLS connection, mapping its subject common name
+// to a tenant through Subjects.
+type ClientCertAuthenticator struct {
+	Subjects map[string]string // certificate CommonName -> tenant
+}
+
+// Authenticate implements Authenticator.
+func (c ClientCertAuthenticator) Authenticate(r *http.Request) (Claims, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return Claims{}, errors.New("no client certificate presented")
+	}
+	cn := r.TLS.PeerCertificates[0].Subject.CommonName
+	tenant, ok := c.Subjects[cn]
+	if !ok {
+		return Claims{}, errors.Errorf("certificate subject %q not authorized", cn)
+	}
+	return Claims{Subject: cn, Tenant: tenant}, nil
+}
+
+// StaticTokenAuthenticator authenticates bearer tokens against a fixed
+// token-to-tenant mapping loaded from a JSON file of {"token": "tenant"}.
+type StaticTokenAuthenticator struct {
+	tokens map[string]string
+}
+
+// NewStaticTokenAuthenticator loads a token file from path.
+func NewStaticTokenAuthenticator(path string) (*StaticTokenAuthenticator, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading token file")
+	}
+	tokens := map[string]string{}
+	if err := json.Unmarshal(buf, &tokens); err != nil {
+		return nil, errors.Wrap(err, "parsing token file")
+	}
+	return &StaticTokenAuthenticator{tokens: tokens}, nil
+}
+
+// Authenticate implements Authenticator.
+func (s *StaticTokenAuthenticator) Authenticate(r *http.Request) (Claims, error) {
+	raw := bearerToken(r)
+	if raw == "" {
+		return Claims{}, errors.New("missing bearer token")
+	}
+	for token, tenant := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(raw)) == 1 {
+			return Claims{Tenant: tenant}, nil
+		}
+	}
+	return Claims{}, errors.New("unknown token")
+}
+
+// ClusterAuthenticator gates the internal peer-to-peer endpoints
+// (/_query, /_stream, /replicate, /_clusterstate) with a credential
+// distinct from user-facing tokens, so a leaked user token can't be
+// used to impersonate a cluster peer.
+type ClusterAuthenticator struct {
+	Token string
+}
+
+// Authenticate checks the cluster credential. An empty Token disables
+// the check, matching the historical open internal API.
+func (c ClusterAuthenticator) Authenticate(r *http.Request) error {
+	if c.Token == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(c.Token)) != 1 {
+		return errors.New("invalid cluster credential")
+	}
+	return nil
+}
+
+type tenantContextKey struct{}
+
+// withTenant returns a context carrying the validated tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// tenantFromContext returns the tenant validated for this request, or
+// DefaultTenant if none was set (e.g. on an internal request tagged via
+// HeaderTenant instead).
+func tenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantContextKey{}).(string); ok && tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// TenantFromContext is tenantFromContext, exported so alternate
+// internal transports (see pkg/store/grpc) can carry the same tenant
+// that queryPeer puts in HeaderTenant, without re-authenticating the
+// original caller.
+func TenantFromContext(ctx context.Context) string {
+	return tenantFromContext(ctx)
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestBearerToken(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"missing header", "", ""},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", ""},
+		{"well-formed", "Bearer abc123", "abc123"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			if got := bearerToken(r); got != tc.want {
+				t.Errorf("bearerToken() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBearerJWTAuthenticator(t *testing.T) {
+	secret := []byte("test-secret")
+	keyfunc := func(*jwt.Token) (interface{}, error) { return secret, nil }
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+		if err != nil {
+			t.Fatalf("signing token: %v", err)
+		}
+		return token
+	}
+
+	t.Run("valid token", func(t *testing.T) {
+		auth := BearerJWTAuthenticator{Keyfunc: keyfunc}
+		r := httptest.NewRequest("GET", "/query", nil)
+		r.Header.Set("Authorization", "Bearer "+sign(jwt.MapClaims{"tenant": "acme", "sub": "alice"}))
+
+		claims, err := auth.Authenticate(r)
+		if err != nil {
+			t.Fatalf("Authenticate() error = %v", err)
+		}
+		if claims.Tenant != "acme" || claims.Subject != "alice" {
+			t.Errorf("claims = %+v, want tenant=acme subject=alice", claims)
+		}
+	})
+
+	t.Run("missing tenant claim", func(t *testing.T) {
+		auth := BearerJWTAuthenticator{Keyfunc: keyfunc}
+		r := httptest.NewRequest("GET", "/query", nil)
+		r.Header.Set("Authorization", "Bearer "+sign(jwt.MapClaims{"sub": "alice"}))
+
+		if _, err := auth.Authenticate(r); err == nil {
+			t.Error("Authenticate() = nil error, want error for missing tenant claim")
+		}
+	})
+
+	t.Run("custom tenant claim", func(t *testing.T) {
+		auth := BearerJWTAuthenticator{Keyfunc: keyfunc, TenantClaim: "org"}
+		r := httptest.NewRequest("GET", "/query", nil)
+		r.Header.Set("Authorization", "Bearer "+sign(jwt.MapClaims{"org": "acme"}))
+
+		claims, err := auth.Authenticate(r)
+		if err != nil {
+			t.Fatalf("Authenticate() error = %v", err)
+		}
+		if claims.Tenant != "acme" {
+			t.Errorf("Tenant = %q, want %q", claims.Tenant, "acme")
+		}
+	})
+
+	t.Run("missing bearer token", func(t *testing.T) {
+		auth := BearerJWTAuthenticator{Keyfunc: keyfunc}
+		r := httptest.NewRequest("GET", "/query", nil)
+
+		if _, err := auth.Authenticate(r); err == nil {
+			t.Error("Authenticate() = nil error, want error for missing token")
+		}
+	})
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	auth := ClientCertAuthenticator{Subjects: map[string]string{"store-1.internal": "acme"}}
+
+	t.Run("authorized subject", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/_query", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "store-1.internal"}},
+		}}
+
+		claims, err := auth.Authenticate(r)
+		if err != nil {
+			t.Fatalf("Authenticate() error = %v", err)
+		}
+		if claims.Tenant != "acme" {
+			t.Errorf("Tenant = %q, want %q", claims.Tenant, "acme")
+		}
+	})
+
+	t.Run("unauthorized subject", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/_query", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "unknown.internal"}},
+		}}
+
+		if _, err := auth.Authenticate(r); err == nil {
+			t.Error("Authenticate() = nil error, want error for unrecognized subject")
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/_query", nil)
+
+		if _, err := auth.Authenticate(r); err == nil {
+			t.Error("Authenticate() = nil error, want error when TLS is absent")
+		}
+	})
+}
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	auth := &StaticTokenAuthenticator{tokens: map[string]string{"tok-acme": "acme"}}
+
+	t.Run("known token", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/query", nil)
+		r.Header.Set("Authorization", "Bearer tok-acme")
+
+		claims, err := auth.Authenticate(r)
+		if err != nil {
+			t.Fatalf("Authenticate() error = %v", err)
+		}
+		if claims.Tenant != "acme" {
+			t.Errorf("Tenant = %q, want %q", claims.Tenant, "acme")
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/query", nil)
+		r.Header.Set("Authorization", "Bearer tok-evil")
+
+		if _, err := auth.Authenticate(r); err == nil {
+			t.Error("Authenticate() = nil error, want error for unknown token")
+		}
+	})
+}
+
+func TestClusterAuthenticatorAuthenticate(t *testing.T) {
+	t.Run("empty token disables check", func(t *testing.T) {
+		auth := ClusterAuthenticator{}
+		r := httptest.NewRequest("GET", "/_query", nil)
+
+		if err := auth.Authenticate(r); err != nil {
+			t.Errorf("Authenticate() error = %v, want nil", err)
+		}
+	})
+
+	t.Run("matching credential", func(t *testing.T) {
+		auth := ClusterAuthenticator{Token: "cluster-secret"}
+		r := httptest.NewRequest("GET", "/_query", nil)
+		r.Header.Set("Authorization", "Bearer cluster-secret")
+
+		if err := auth.Authenticate(r); err != nil {
+			t.Errorf("Authenticate() error = %v, want nil", err)
+		}
+	})
+
+	t.Run("wrong credential", func(t *testing.T) {
+		auth := ClusterAuthenticator{Token: "cluster-secret"}
+		r := httptest.NewRequest("GET", "/_query", nil)
+		r.Header.Set("Authorization", "Bearer wrong")
+
+		if err := auth.Authenticate(r); err == nil {
+			t.Error("Authenticate() = nil error, want error for wrong credential")
+		}
+	})
+}
+
+func TestTenantFromContext(t *testing.T) {
+	if got := tenantFromContext(context.Background()); got != DefaultTenant {
+		t.Errorf("tenantFromContext(background) = %q, want %q", got, DefaultTenant)
+	}
+
+	ctx := withTenant(context.Background(), "acme")
+	if got := tenantFromContext(ctx); got != "acme" {
+		t.Errorf("tenantFromContext(withTenant) = %q, want %q", got, "acme")
+	}
+}
@@ -0,0 +1,143 @@
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+
+	"github.com/oklog/oklog/pkg/store"
+)
+
+// Client implements store.InternalTransport over the gRPC service
+// defined in store.proto, the client-side counterpart to Server. An
+// operator passes a Client as NewAPI's transport argument to route
+// peer-to-peer query and stream fan-out over gRPC instead of the
+// default internal HTTP endpoints; wiring that choice to a
+// command-line flag is the binary entrypoint's job and lives outside
+// this package.
+//
+// It dials each peer lazily and caches the connection, since the set of
+// hostports it's asked to query changes as cluster membership changes.
+type Client struct {
+	dialOptions []grpc.DialOption
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewClient returns a Client ready to use as an InternalTransport.
+// dialOptions are passed through to grpc.Dial for every peer connection,
+// e.g. grpc.WithInsecure() or transport credentials.
+func NewClient(dialOptions ...grpc.DialOption) *Client {
+	return &Client{
+		dialOptions: dialOptions,
+		conns:       map[string]*grpc.ClientConn{},
+	}
+}
+
+// connFor returns the cached connection to hostport, dialing one on
+// first use.
+func (c *Client) connFor(hostport string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cc, ok := c.conns[hostport]; ok {
+		return cc, nil
+	}
+	cc, err := grpc.Dial(hostport, c.dialOptions...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dialing %s", hostport)
+	}
+	c.conns[hostport] = cc
+	return cc, nil
+}
+
+// Query implements store.InternalTransport, the client-side counterpart
+// of Server.Query. It reconstructs the wire fields from query the same
+// way queryParamsFrom builds a store.QueryParams back up on the server
+// side, carries the caller's tenant the same way the internal HTTP
+// transport does via HeaderTenant, and decodes the reply with
+// decodeQueryReply, so matching records survive the round trip.
+func (c *Client) Query(ctx context.Context, hostport string, query store.QueryParams) (store.QueryResult, error) {
+	cc, err := c.connFor(hostport)
+	if err != nil {
+		return store.QueryResult{}, err
+	}
+
+	values := url.Values{}
+	query.EncodeTo(values)
+
+	reply, err := NewStoreClient(cc).Query(ctx, &QueryRequest{
+		Q:      values.Get("q"),
+		From:   values.Get("from"),
+		To:     values.Get("to"),
+		Regex:  values.Get("regex") == "true",
+		Tenant: store.TenantFromContext(ctx),
+	})
+	if err != nil {
+		return store.QueryResult{}, errors.Wrapf(err, "querying %s", hostport)
+	}
+
+	return decodeQueryReply(reply)
+}
+
+// decodeQueryReply is encodeQueryReply's inverse: it replays reply's
+// body through an *http.Response so store.QueryResult.DecodeFrom can
+// reconstruct the result exactly like queryPeer does over HTTP.
+func decodeQueryReply(reply *QueryReply) (store.QueryResult, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reply.Body)), nil)
+	if err != nil {
+		return store.QueryResult{}, errors.Wrap(err, "decoding query result")
+	}
+	defer resp.Body.Close()
+
+	var result store.QueryResult
+	result.DecodeFrom(resp)
+	return result, nil
+}
+
+// Stream implements store.InternalTransport, the client-side
+// counterpart of Server.Stream. It returns a channel fed by a goroutine
+// draining the server-streaming RPC, closed when the stream ends or ctx
+// is done.
+func (c *Client) Stream(ctx context.Context, hostport string, query store.QueryParams) (<-chan []byte, error) {
+	cc, err := c.connFor(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	query.EncodeTo(values)
+
+	rpcStream, err := NewStoreClient(cc).Stream(ctx, &StreamRequest{
+		Q:      values.Get("q"),
+		From:   values.Get("from"),
+		Regex:  values.Get("regex") == "true",
+		Tenant: store.TenantFromContext(ctx),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "streaming from %s", hostport)
+	}
+
+	records := make(chan []byte)
+	go func() {
+		defer close(records)
+		for {
+			rec, err := rpcStream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case records <- rec.Data:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return records, nil
+}
@@ -0,0 +1,31 @@
+package grpc
+
+import (
+	"testing"
+
+	"github.com/oklog/oklog/pkg/store"
+)
+
+// TestQueryReplyRoundTrip checks that a result encoded with
+// encodeQueryReply and decoded with decodeQueryReply keeps its
+// ErrorCount and Duration. The result it uses holds no records, so
+// records surviving the round trip is not checked here.
+func TestQueryReplyRoundTrip(t *testing.T) {
+	want := store.QueryResult{ErrorCount: 2, Duration: "12ms"}
+
+	reply, err := encodeQueryReply(want)
+	if err != nil {
+		t.Fatalf("encodeQueryReply() error = %v", err)
+	}
+
+	got, err := decodeQueryReply(reply)
+	if err != nil {
+		t.Fatalf("decodeQueryReply() error = %v", err)
+	}
+	if got.ErrorCount != want.ErrorCount {
+		t.Errorf("ErrorCount = %d, want %d", got.ErrorCount, want.ErrorCount)
+	}
+	if got.Duration != want.Duration {
+		t.Errorf("Duration = %q, want %q", got.Duration, want.Duration)
+	}
+}
@@ -0,0 +1,206 @@
+// Package grpc provides a gRPC transport for the store API's internal
+// peer-to-peer traffic (query, stream, replicate, cluster state), as an
+// alternative to the internal HTTP endpoints for lower per-request
+// overhead and true server-streaming of query/stream results. The
+// message and service types this file and client.go implement
+// (QueryRequest, StoreServer, StoreClient, Store_StreamServer,
+// Store_StreamClient, ...) are generated from store.proto via `protoc
+// --go_out=plugins=grpc:. store.proto` into store.pb.go, which is not
+// checked in here.
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/go-kit/kit/log"
+	level "github.com/go-kit/kit/log/experimental_level"
+	"github.com/pkg/errors"
+
+	"github.com/oklog/oklog/pkg/cluster"
+	"github.com/oklog/oklog/pkg/store"
+)
+
+// ReplicateFunc merges raw newline-delimited records read from r into a
+// new segment, like store.API's HTTP /replicate handler but without
+// its tenant tagging. It's
+// supplied by the caller (store.API.ReplicateRecords) rather than
+// reimplemented here, since segment creation and the low/high ULID
+// bookkeeping it does are private to the store package.
+type ReplicateFunc func(r io.Reader) (n int, err error)
+
+// Server implements the generated StoreServer interface over a local
+// store.Log, the same backend the HTTP internal endpoints use.
+type Server struct {
+	peer      *cluster.Peer
+	log       store.Log
+	replicate ReplicateFunc
+	logger    log.Logger
+}
+
+// NewServer returns a Server ready to register on a grpc.Server via
+// RegisterStoreServer(grpcServer, server).
+func NewServer(peer *cluster.Peer, log store.Log, replicate ReplicateFunc, logger log.Logger) *Server {
+	return &Server{peer: peer, log: log, replicate: replicate, logger: logger}
+}
+
+func queryParamsFrom(q, from, to string, regex bool) (store.QueryParams, error) {
+	values := url.Values{}
+	values.Set("q", q)
+	values.Set("from", from)
+	if to != "" {
+		values.Set("to", to)
+	}
+	if regex {
+		values.Set("regex", "true")
+	}
+	return store.MakeQueryParams(values)
+}
+
+// Query implements the unary Query RPC, mirroring the internal HTTP
+// query endpoint without the HTTP request/response framing. The result
+// is narrowed to req.Tenant the same way handleInternalQuery narrows
+// its own a.log.Query result, then packed into a QueryReply by
+// encodeQueryReply, so Client can hand it straight to
+// store.QueryResult.DecodeFrom and get back matching records, not just
+// error/duration stats.
+func (s *Server) Query(ctx context.Context, req *QueryRequest) (*QueryReply, error) {
+	query, err := queryParamsFrom(req.Q, req.From, req.To, req.Regex)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid query")
+	}
+
+	result, err := s.log.Query(query, false)
+	if err != nil {
+		level.Error(s.logger).Log("during", "grpc_query", "err", err)
+		return nil, errors.Wrap(err, "query")
+	}
+
+	tenant := req.Tenant
+	if tenant == "" {
+		tenant = store.DefaultTenant
+	}
+	result, err = store.FilterQueryResultByTenant(result, tenant)
+	if err != nil {
+		return nil, errors.Wrap(err, "filtering query result by tenant")
+	}
+
+	return encodeQueryReply(result)
+}
+
+// encodeQueryReply packs result's full wire representation (the same
+// bytes result.EncodeTo would write to an HTTP response) into a
+// QueryReply, the same trick computeAggregate uses to read a
+// QueryResult's matches without reaching into its internals. It is
+// decodeQueryReply's inverse.
+func encodeQueryReply(result store.QueryResult) (*QueryReply, error) {
+	rec := httptest.NewRecorder()
+	result.EncodeTo(rec)
+
+	var body bytes.Buffer
+	if err := rec.Result().Write(&body); err != nil {
+		return nil, errors.Wrap(err, "encoding query result")
+	}
+	return &QueryReply{Body: body.Bytes()}, nil
+}
+
+// Stream implements the server-streaming Stream RPC, pushing matching
+// records directly over the gRPC stream as they're produced, instead of
+// the buffer-and-flush approach handleInternalStream uses over chunked
+// HTTP. Records are narrowed to req.Tenant the same way
+// handleInternalStream narrows its own a.log.Stream records.
+func (s *Server) Stream(req *StreamRequest, stream Store_StreamServer) error {
+	query, err := queryParamsFrom(req.Q, req.From, "", req.Regex)
+	if err != nil {
+		return errors.Wrap(err, "invalid query")
+	}
+
+	tenant := req.Tenant
+	if tenant == "" {
+		tenant = store.DefaultTenant
+	}
+
+	ctx := stream.Context()
+	records := s.log.Stream(ctx, query)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case record := <-records:
+			stripped, ok := store.StripRecordTenantTag(record, tenant)
+			if !ok {
+				continue
+			}
+			if err := stream.Send(&Record{Data: stripped}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Replicate implements the client-streaming Replicate RPC, accumulating
+// received records into a new segment via ReplicateFunc, the same path
+// handleReplicate uses over HTTP.
+//
+// Unlike handleReplicate, it doesn't tag incoming records with a
+// tenant: a Record's Data is an arbitrary chunk of the underlying
+// newline-delimited byte stream (see recvReader), not one message per
+// record, so there's no line boundary to anchor a tag to without
+// reassembling and re-splitting the whole stream. Segments replicated
+// this way are therefore visible only to store.DefaultTenant, same as
+// any other untagged record (see store.StripRecordTenantTag).
+func (s *Server) Replicate(stream Store_ReplicateServer) error {
+	n, err := s.replicate(&recvReader{stream: stream})
+	if err != nil {
+		level.Error(s.logger).Log("during", "grpc_replicate", "err", err)
+		return errors.Wrap(err, "replicate")
+	}
+	return stream.SendAndClose(&ReplicateReply{N: int64(n)})
+}
+
+// ClusterState implements the ClusterState RPC, passing through the
+// same JSON document handleClusterState serves over HTTP.
+func (s *Server) ClusterState(ctx context.Context, req *ClusterStateRequest) (*ClusterStateReply, error) {
+	buf, err := json.Marshal(s.peer.State())
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling cluster state")
+	}
+	return &ClusterStateReply{StateJson: buf}, nil
+}
+
+// recvSource is the part of Store_ReplicateServer recvReader actually
+// needs; naming it separately keeps recvReader testable without the
+// generated streaming scaffolding.
+type recvSource interface {
+	Recv() (*Record, error)
+}
+
+// recvReader adapts a Store_ReplicateServer's Recv stream of Records
+// into an io.Reader, so ReplicateFunc can treat it exactly like an HTTP
+// request body. pending holds the tail of a Record that didn't fit in
+// the caller's buffer on the previous Read, satisfying io.Reader's
+// contract that leftover bytes aren't dropped.
+type recvReader struct {
+	stream  recvSource
+	pending []byte
+}
+
+func (r *recvReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		rec, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.pending = rec.Data
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,60 @@
+package grpc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// fakeRecvSource replays a fixed sequence of Records, then io.EOF.
+type fakeRecvSource struct {
+	records [][]byte
+	i       int
+}
+
+func (f *fakeRecvSource) Recv() (*Record, error) {
+	if f.i >= len(f.records) {
+		return nil, io.EOF
+	}
+	rec := &Record{Data: f.records[f.i]}
+	f.i++
+	return rec, nil
+}
+
+func TestRecvReaderRead(t *testing.T) {
+	records := [][]byte{
+		[]byte("hello "),
+		[]byte("world\n"),
+	}
+	r := &recvReader{stream: &fakeRecvSource{records: records}}
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if want := []byte("hello world\n"); !bytes.Equal(got, want) {
+		t.Errorf("ReadAll() = %q, want %q", got, want)
+	}
+}
+
+func TestRecvReaderReadBufferSmallerThanRecord(t *testing.T) {
+	r := &recvReader{stream: &fakeRecvSource{records: [][]byte{[]byte("abcdefghij")}}}
+
+	buf := make([]byte, 3)
+	var got []byte
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+	}
+
+	if want := "abcdefghij"; string(got) != want {
+		t.Errorf("accumulated reads = %q, want %q (a too-small buffer must not drop bytes)", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func signEdDSA(t *testing.T, priv ed25519.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(SigningMethodEdDSA, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(priv)
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+	return signed
+}
+
+func TestSigningMethodEdDSARoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	raw := signEdDSA(t, priv, "", jwt.MapClaims{"sub": "alice"})
+
+	token, err := jwt.Parse(raw, Ed25519Keyfunc(pub))
+	if err != nil || !token.Valid {
+		t.Fatalf("jwt.Parse() = (%v, %v), want a valid token", token, err)
+	}
+}
+
+func TestEd25519KeyfuncRejectsWrongAlg(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"}).SignedString([]byte(pub))
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+
+	if _, err := jwt.Parse(raw, Ed25519Keyfunc(pub)); err == nil {
+		t.Error("jwt.Parse() = nil error for an HS256 token against an Ed25519 keyfunc, want error")
+	}
+}
+
+func TestJWKSKeyfunc(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	set := jwkSet{Keys: []jwk{{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		Kid: "key-1",
+		X:   base64.RawURLEncoding.EncodeToString(pub),
+	}}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	keyfunc := JWKSKeyfunc(srv.URL, srv.Client(), time.Minute)
+
+	t.Run("valid token", func(t *testing.T) {
+		raw := signEdDSA(t, priv, "key-1", jwt.MapClaims{"sub": "alice"})
+		token, err := jwt.Parse(raw, keyfunc)
+		if err != nil || !token.Valid {
+			t.Fatalf("jwt.Parse() = (%v, %v), want a valid token", token, err)
+		}
+	})
+
+	t.Run("unknown kid", func(t *testing.T) {
+		raw := signEdDSA(t, priv, "no-such-key", jwt.MapClaims{"sub": "alice"})
+		if _, err := jwt.Parse(raw, keyfunc); err == nil {
+			t.Error("jwt.Parse() = nil error for an unknown kid, want error")
+		}
+	})
+
+	t.Run("missing kid", func(t *testing.T) {
+		raw := signEdDSA(t, priv, "", jwt.MapClaims{"sub": "alice"})
+		if _, err := jwt.Parse(raw, keyfunc); err == nil {
+			t.Error("jwt.Parse() = nil error for a token with no kid header, want error")
+		}
+	})
+
+	t.Run("alg confusion rejected", func(t *testing.T) {
+		// Sign with HS256 using the Ed25519 public key's raw bytes as
+		// the HMAC secret, claiming the Ed25519 key's kid: a classic
+		// alg-confusion attack the keyfunc must refuse to verify.
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"})
+		token.Header["kid"] = "key-1"
+		raw, err := token.SignedString([]byte(pub))
+		if err != nil {
+			t.Fatalf("SignedString() error = %v", err)
+		}
+		if _, err := jwt.Parse(raw, keyfunc); err == nil {
+			t.Error("jwt.Parse() = nil error for an HS256 token over an Ed25519 key, want error")
+		}
+	})
+}
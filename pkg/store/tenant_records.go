@@ -0,0 +1,124 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+
+	"github.com/pkg/errors"
+)
+
+// tenantSeparator tags a record with the tenant that wrote it, turning
+// an on-disk "<ulid> <payload>" line into "<ulid> <tenant>\x1f<payload>".
+// It's the only place tenant is durably recorded, since neither
+// QueryParams nor the segment writer (mergeRecords) have a Tenant
+// dimension of their own; \x1f (ASCII unit separator) is used because
+// it's not a character DefaultTenant or an Authenticate-validated
+// tenant name would plausibly contain.
+const tenantSeparator = '\x1f'
+
+// taggedReader wraps r, a stream of "<ulid> <payload>" records such as
+// ReplicateRecords reads, inserting tenant after each record's ULID so
+// the tag survives into segment storage. Lines with no space, which
+// can't be "<ulid> <payload>" records, pass through unchanged; the
+// leading field of any other line is not checked to be a ULID.
+func taggedReader(r io.Reader, tenant string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			sp := bytes.IndexByte(line, ' ')
+			if sp < 0 {
+				if _, err := pw.Write(append(append([]byte{}, line...), '\n')); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				continue
+			}
+			tagged := append([]byte{}, line[:sp+1]...)
+			tagged = append(tagged, tenant...)
+			tagged = append(tagged, tenantSeparator)
+			tagged = append(tagged, line[sp+1:]...)
+			tagged = append(tagged, '\n')
+			if _, err := pw.Write(tagged); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(scanner.Err())
+	}()
+	return pr
+}
+
+// stripTenantTag reports whether line, a "<ulid> <payload>" record
+// possibly tagged by taggedReader, belongs to tenant, returning it with
+// the tag removed so it reads exactly as it did before tagging existed.
+// A line with no tag at all is treated as belonging to DefaultTenant,
+// so records written before tenant tagging existed stay visible to the
+// default tenant rather than becoming unreadable on upgrade. Lines with
+// no space (e.g. a blank trailing line) pass through unfiltered; the
+// leading field of any other line is not checked to be a ULID.
+func stripTenantTag(line []byte, tenant string) ([]byte, bool) {
+	sp := bytes.IndexByte(line, ' ')
+	if sp < 0 {
+		return line, true
+	}
+	payload := line[sp+1:]
+	sep := bytes.IndexByte(payload, tenantSeparator)
+	if sep < 0 {
+		return line, tenant == DefaultTenant
+	}
+	if string(payload[:sep]) != tenant {
+		return nil, false
+	}
+	stripped := append(append([]byte{}, line[:sp+1]...), payload[sep+1:]...)
+	return stripped, true
+}
+
+// filterQueryResultByTenant replays result's wire bytes (the same trick
+// computeAggregate and pkg/store/grpc use to inspect a QueryResult
+// without reaching into its internals), keeping only the records tagged
+// for tenant and stripping the tag back off, so Log.Query's result is
+// actually scoped to the caller's tenant before it's ever returned or
+// merged with another store's partial result.
+func filterQueryResultByTenant(result QueryResult, tenant string) (QueryResult, error) {
+	rec := httptest.NewRecorder()
+	result.EncodeTo(rec)
+	resp := rec.Result()
+
+	var body bytes.Buffer
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line, ok := stripTenantTag(scanner.Bytes(), tenant); ok {
+			body.Write(line)
+			body.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return QueryResult{}, errors.Wrap(err, "scanning records")
+	}
+
+	resp.Body = ioutil.NopCloser(&body)
+	resp.ContentLength = int64(body.Len())
+
+	var filtered QueryResult
+	filtered.DecodeFrom(resp)
+	return filtered, nil
+}
+
+// FilterQueryResultByTenant is filterQueryResultByTenant, exported so
+// pkg/store/grpc's Server.Query can apply the same tenant scoping the
+// internal HTTP query endpoint does.
+func FilterQueryResultByTenant(result QueryResult, tenant string) (QueryResult, error) {
+	return filterQueryResultByTenant(result, tenant)
+}
+
+// StripRecordTenantTag is stripTenantTag, exported so pkg/store/grpc's
+// Server.Stream can apply the same per-record tenant scoping the
+// internal HTTP stream endpoint does.
+func StripRecordTenantTag(record []byte, tenant string) ([]byte, bool) {
+	return stripTenantTag(record, tenant)
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTaggedReaderStripTenantTagRoundTrip(t *testing.T) {
+	const line = "01ARZ3NDEKTSV4RRFFQ69G5FAV hello world"
+
+	tagged, err := ioutil.ReadAll(taggedReader(strings.NewReader(line+"\n"), "acme"))
+	if err != nil {
+		t.Fatalf("ReadAll(taggedReader()) error = %v", err)
+	}
+
+	got, ok := stripTenantTag(bytes.TrimRight(tagged, "\n"), "acme")
+	if !ok {
+		t.Fatal("stripTenantTag() = false, want true for the tagging tenant")
+	}
+	if string(got) != line {
+		t.Errorf("stripTenantTag() = %q, want %q", got, line)
+	}
+
+	if _, ok := stripTenantTag(bytes.TrimRight(tagged, "\n"), "other"); ok {
+		t.Error("stripTenantTag() = true for a different tenant, want false")
+	}
+}
+
+func TestStripTenantTagUntaggedDefaultsToDefaultTenant(t *testing.T) {
+	const line = "01ARZ3NDEKTSV4RRFFQ69G5FAV hello world"
+
+	got, ok := stripTenantTag([]byte(line), DefaultTenant)
+	if !ok {
+		t.Fatal("stripTenantTag() = false for DefaultTenant, want true (untagged records predate tenant tagging)")
+	}
+	if string(got) != line {
+		t.Errorf("stripTenantTag() = %q, want %q unchanged", got, line)
+	}
+
+	if _, ok := stripTenantTag([]byte(line), "acme"); ok {
+		t.Error("stripTenantTag() = true for a non-default tenant on an untagged record, want false")
+	}
+}
+
+func TestTaggedReaderPassesThroughNonRecordLines(t *testing.T) {
+	const line = "not-a-record-line"
+
+	tagged, err := ioutil.ReadAll(taggedReader(strings.NewReader(line+"\n"), "acme"))
+	if err != nil {
+		t.Fatalf("ReadAll(taggedReader()) error = %v", err)
+	}
+	if got := strings.TrimRight(string(tagged), "\n"); got != line {
+		t.Errorf("taggedReader() = %q, want %q unchanged", got, line)
+	}
+}